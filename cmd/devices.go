@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"github.com/grantyap/qonvert/internal/transcode"
+	"github.com/spf13/cobra"
+)
+
+var devicesCommand = &cobra.Command{
+	Use:   "devices",
+	Short: "Show the encoder and hwaccel decode flags --codec auto picks for each codec family on this machine",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		caps, err := transcode.DetectHWAccel()
+		if err != nil {
+			cmd.PrintErrln("could not detect hardware acceleration", err)
+			return
+		}
+
+		for _, family := range []string{"h265", "h264", "av1"} {
+			resolvedCodec, decodeArgs, _ := caps.Resolve(family)
+			cmd.Printf("%s: %s %v\n", family, resolvedCodec, decodeArgs)
+		}
+	},
+}
+
+func init() {
+	rootCommand.AddCommand(devicesCommand)
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"github.com/grantyap/qonvert/internal/transcode"
+	"github.com/spf13/cobra"
+)
+
+var failedCommand = &cobra.Command{
+	Use:   "failed",
+	Short: "List items from the --on-existing resume manifest that failed to transcode",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := transcode.ReadManifest(outputPath)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.ExitCode == 0 {
+				continue
+			}
+
+			cmd.Printf("%s -> %s (exit %d)\n", entry.Input, entry.Output, entry.ExitCode)
+		}
+	},
+}
+
+var retryCommand = &cobra.Command{
+	Use:   "retry",
+	Short: "Re-transcode the items recorded as failed in the --on-existing resume manifest",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		entries, err := transcode.ReadManifest(outputPath)
+		if err != nil {
+			cmd.PrintErrln(err)
+			return
+		}
+
+		var retried int
+		for _, entry := range entries {
+			if entry.ExitCode == 0 {
+				continue
+			}
+
+			item := transcode.Item{
+				InputPath:    entry.Input,
+				OutputPath:   entry.Output,
+				OnExisting:   "overwrite",
+				HWAccelArgs:  entry.HWAccelArgs,
+				OutputFormat: entry.OutputFormat,
+				Ladder:       entry.Ladder,
+			}
+			items := transcode.ReadFrameCounts([]transcode.Item{item}, 1)
+			if len(items) == 0 {
+				cmd.Println("skipping, could not read frame count:", entry.Input)
+				continue
+			}
+
+			progress := make(chan transcode.ItemWithProgress)
+			go func() {
+				for range progress {
+				}
+			}()
+
+			// Re-encode with the codec the original run resolved, not the current --codec flag,
+			// which may be "auto" or may no longer match what produced entry.Output.
+			if err := transcode.Execute(items[0], entry.Codec, progress); err != nil {
+				cmd.Println("failed:", entry.Output, err)
+				continue
+			}
+
+			entry.ExitCode = 0
+			if recordErr := transcode.RecordManifestEntry(entry); recordErr != nil {
+				cmd.Println("retried but failed to update manifest:", entry.Output, recordErr)
+			}
+
+			retried++
+		}
+
+		cmd.Println("retried", retried, "items")
+	},
+}
+
+func init() {
+	rootCommand.AddCommand(failedCommand)
+	rootCommand.AddCommand(retryCommand)
+}
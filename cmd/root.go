@@ -1,9 +1,11 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,10 +16,16 @@ import (
 )
 
 var (
-	outputPath string
-	outputType string
-	codec      string
-	limit      uint
+	outputPath   string
+	outputType   string
+	codec        string
+	family       string
+	limit        uint
+	segments     uint
+	outputFormat string
+	ladder       string
+	onExisting   string
+	progressMode string
 
 	rootCommand = &cobra.Command{
 		Use:   "qo",
@@ -38,10 +46,52 @@ var (
 
 			items := transcode.ReadFrameCounts(filePaths, 50)
 
+			for i := range items {
+				items[i].Item.OnExisting = onExisting
+			}
+
+			resolvedCodec := codec
+			if codec == "auto" {
+				caps, err := transcode.DetectHWAccel()
+				if err != nil {
+					cmd.PrintErrln("could not detect hardware acceleration", err)
+				} else {
+					var decodeArgs []string
+					var ok bool
+					resolvedCodec, decodeArgs, ok = caps.Resolve(family)
+					if !ok {
+						cmd.PrintErrln("unknown codec family:", family)
+						return
+					}
+					for i := range items {
+						items[i].Item.HWAccelArgs = decodeArgs
+					}
+					cmd.Println("auto-detected codec:", resolvedCodec)
+				}
+			}
+
+			if outputFormat != "" {
+				ladderRungs, err := transcode.ParseLadder(ladder)
+				if err != nil {
+					cmd.PrintErrln(err)
+				} else {
+					for i := range items {
+						item := items[i].Item
+						item.OutputFormat = outputFormat
+						item.Ladder = ladderRungs
+						item.OutputPath = strings.TrimSuffix(item.OutputPath, filepath.Ext(item.OutputPath))
+					}
+				}
+			}
+
 			cmd.Printf("transcoding %v items\n", len(items))
 
 			var wg sync.WaitGroup
-			progress := mpb.New(mpb.WithWaitGroup(&wg))
+
+			var bars *mpb.Progress
+			if progressMode == "bars" {
+				bars = mpb.New(mpb.WithWaitGroup(&wg))
+			}
 
 			type ItemWithProgressBar struct {
 				Item        *transcode.ItemWithProgress
@@ -51,6 +101,8 @@ var (
 			wg.Add(len(items))
 			jobs := make(chan ItemWithProgressBar, len(items))
 
+			var jsonOut jsonEncoder
+
 			for i := uint(0); i < limit; i++ {
 				go func() {
 					for item := range jobs {
@@ -60,17 +112,27 @@ var (
 
 						go func() {
 							for p := range progress {
-								deltaFrames := p.CurrentFrame - previousFrameCount
-								now := time.Now()
-								deltaTime := now.Sub(previousTime)
-								previousTime = now
-
-								previousFrameCount = p.CurrentFrame
-								item.ProgressBar.EwmaIncrBy(int(deltaFrames), deltaTime)
+								switch {
+								case progressMode == "json":
+									jsonOut.encode(item.Item.Item.OutputPath, p)
+								case item.ProgressBar != nil:
+									deltaFrames := p.CurrentFrame - previousFrameCount
+									now := time.Now()
+									deltaTime := now.Sub(previousTime)
+									previousTime = now
+
+									previousFrameCount = p.CurrentFrame
+									item.ProgressBar.EwmaIncrBy(int(deltaFrames), deltaTime)
+								}
 							}
 						}()
 
-						err := transcode.Execute(*item.Item, codec, progress)
+						var err error
+						if segments > 1 {
+							err = transcode.SegmentedExecute(*item.Item, resolvedCodec, int(segments), progress)
+						} else {
+							err = transcode.Execute(*item.Item, resolvedCodec, progress)
+						}
 						if err != nil {
 							cmd.Println("failed:", item.Item.Item.OutputPath, err)
 						}
@@ -81,26 +143,29 @@ var (
 			}
 
 			for _, item := range items {
-				name, err := filepath.Rel(outputPath, item.Item.OutputPath)
-				if err != nil {
-					cmd.PrintErr(err)
-					continue
-				}
+				var bar *mpb.Bar
+				if bars != nil {
+					name, err := filepath.Rel(outputPath, item.Item.OutputPath)
+					if err != nil {
+						cmd.PrintErr(err)
+						continue
+					}
 
-				bar := progress.AddBar(int64(item.FrameCount),
-					mpb.PrependDecorators(
-						decor.Name(name, decor.WCSyncSpace),
-						decor.Any(func(s decor.Statistics) string {
-							return fmt.Sprintf("%v/%v", s.Current, s.Total)
-						}, decor.WCSyncSpace),
-						decor.Percentage(decor.WCSyncSpace),
-					),
-					mpb.AppendDecorators(
-						decor.OnComplete(
-							decor.EwmaETA(decor.ET_STYLE_GO, 30, decor.WCSyncWidth), "done",
+					bar = bars.AddBar(int64(item.FrameCount),
+						mpb.PrependDecorators(
+							decor.Name(name, decor.WCSyncSpace),
+							decor.Any(func(s decor.Statistics) string {
+								return fmt.Sprintf("%v/%v", s.Current, s.Total)
+							}, decor.WCSyncSpace),
+							decor.Percentage(decor.WCSyncSpace),
+						),
+						mpb.AppendDecorators(
+							decor.OnComplete(
+								decor.EwmaETA(decor.ET_STYLE_GO, 30, decor.WCSyncWidth), "done",
+							),
 						),
-					),
-				)
+					)
+				}
 
 				jobs <- ItemWithProgressBar{
 					Item:        &item,
@@ -124,10 +189,51 @@ func init() {
 
 	rootCommand.PersistentFlags().StringVarP(&outputPath, "output-path", "o", workingDirectory, "file path containing all the transcoded output videos")
 	rootCommand.PersistentFlags().StringVarP(&outputType, "output-type", "t", "", "output file extension")
-	rootCommand.PersistentFlags().StringVarP(&codec, "codec", "c", "", "video codec to use for transcoding")
+	rootCommand.PersistentFlags().StringVarP(&codec, "codec", "c", "", "video codec to use for transcoding, or \"auto\" to pick the fastest available hardware encoder")
+	rootCommand.PersistentFlags().StringVar(&family, "family", "h265", "codec family to use when --codec auto resolves a hardware encoder: \"h265\", \"h264\", or \"av1\"")
 	rootCommand.PersistentFlags().UintVarP(&limit, "limit", "l", 5, "number of concurrent FFmpeg processes")
+	rootCommand.PersistentFlags().UintVarP(&segments, "segments", "s", 1, "number of keyframe-aligned segments to split each file into for concurrent transcoding")
+	rootCommand.PersistentFlags().StringVar(&outputFormat, "output-format", "", "write a segmented streaming ladder instead of a single file: \"hls\" or \"dash\"")
+	rootCommand.PersistentFlags().StringVar(&ladder, "ladder", "480:1000k,720:2500k,1080:5000k", "comma-separated HEIGHT:BITRATE rungs to encode when --output-format is set")
+	rootCommand.PersistentFlags().StringVar(&onExisting, "on-existing", "overwrite", "what to do when an output file already exists: \"skip\", \"overwrite\", \"rename\", or \"resume\"")
+	rootCommand.PersistentFlags().StringVar(&progressMode, "progress", "bars", "how to report progress: \"bars\", \"json\" (NDJSON on stdout), or \"none\"")
 }
 
 func Execute() error {
 	return rootCommand.Execute()
 }
+
+// jsonProgressEvent is one line of --progress json output.
+type jsonProgressEvent struct {
+	File        string  `json:"file"`
+	Frame       uint64  `json:"frame"`
+	FPS         float64 `json:"fps"`
+	BitrateKbps float64 `json:"bitrate_kbps"`
+	Speed       float64 `json:"speed"`
+	Progress    string  `json:"progress"`
+}
+
+// jsonEncoder writes NDJSON progress events to stdout, serializing writes from the concurrent
+// transcode workers so lines never interleave.
+type jsonEncoder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (e *jsonEncoder) encode(file string, p transcode.ItemWithProgress) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.enc == nil {
+		e.enc = json.NewEncoder(os.Stdout)
+	}
+
+	e.enc.Encode(jsonProgressEvent{
+		File:        file,
+		Frame:       p.CurrentFrame,
+		FPS:         p.FPS,
+		BitrateKbps: p.BitrateKbps,
+		Speed:       p.Speed,
+		Progress:    p.Progress,
+	})
+}
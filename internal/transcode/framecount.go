@@ -5,6 +5,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func ReadFrameCount(path FilePath) (uint64, error) {
@@ -49,11 +50,33 @@ func probe(path FilePath) (string, error) {
 type Item struct {
 	InputPath  string
 	OutputPath string
+
+	// HWAccelArgs are extra ffmpeg decode flags (e.g. "-hwaccel videotoolbox") placed ahead of
+	// -i, as recommended by DetectHWAccel for the encoder this item will use.
+	HWAccelArgs []string
+
+	// OutputFormat is "", "hls", or "dash". When set, OutputPath is treated as a directory and
+	// Ladder must describe at least one rung.
+	OutputFormat string
+	Ladder       []LadderRung
+
+	// OnExisting controls what happens when OutputPath already exists: "" behaves like the
+	// historical always-overwrite behavior, "skip" leaves it alone, "rename" picks a new
+	// OutputPath, and "resume" consults the resume manifest.
+	OnExisting string
 }
 type ItemWithProgress struct {
 	Item         *Item
 	CurrentFrame uint64
 	FrameCount   uint64
+
+	// The remaining fields are only populated once transcoding has started, from ffmpeg's
+	// -progress stream. See ProgressEvent.
+	FPS         float64
+	Speed       float64
+	BitrateKbps float64
+	OutTime     time.Duration
+	Progress    string
 }
 
 func ReadFrameCounts(items []Item, workers int) []ItemWithProgress {
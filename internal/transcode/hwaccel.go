@@ -0,0 +1,125 @@
+package transcode
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+)
+
+// hwCandidate is one hardware-accelerated encoder qonvert knows how to pick, in the order it
+// should be preferred within its codec family.
+type hwCandidate struct {
+	Codec  string
+	Family string
+
+	// HWAccel is the name ffmpeg -hwaccels reports for the decoder DecodeArgs selects (e.g.
+	// "videotoolbox"). The candidate is only usable when this is present in HWAccelCapabilities.HWAccels.
+	HWAccel    string
+	DecodeArgs []string
+}
+
+var hwCandidates = []hwCandidate{
+	{Codec: "hevc_videotoolbox", Family: "h265", HWAccel: "videotoolbox", DecodeArgs: []string{"-hwaccel", "videotoolbox"}},
+	{Codec: "hevc_nvenc", Family: "h265", HWAccel: "cuda", DecodeArgs: []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}},
+	{Codec: "hevc_qsv", Family: "h265", HWAccel: "qsv", DecodeArgs: []string{"-hwaccel", "qsv"}},
+	{Codec: "hevc_vaapi", Family: "h265", HWAccel: "vaapi", DecodeArgs: []string{"-hwaccel", "vaapi"}},
+	{Codec: "hevc_amf", Family: "h265", HWAccel: "d3d11va", DecodeArgs: []string{"-hwaccel", "d3d11va"}},
+
+	{Codec: "h264_videotoolbox", Family: "h264", HWAccel: "videotoolbox", DecodeArgs: []string{"-hwaccel", "videotoolbox"}},
+	{Codec: "h264_nvenc", Family: "h264", HWAccel: "cuda", DecodeArgs: []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}},
+	{Codec: "h264_qsv", Family: "h264", HWAccel: "qsv", DecodeArgs: []string{"-hwaccel", "qsv"}},
+	{Codec: "h264_vaapi", Family: "h264", HWAccel: "vaapi", DecodeArgs: []string{"-hwaccel", "vaapi"}},
+	{Codec: "h264_amf", Family: "h264", HWAccel: "d3d11va", DecodeArgs: []string{"-hwaccel", "d3d11va"}},
+
+	{Codec: "av1_nvenc", Family: "av1", HWAccel: "cuda", DecodeArgs: []string{"-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}},
+	{Codec: "av1_qsv", Family: "av1", HWAccel: "qsv", DecodeArgs: []string{"-hwaccel", "qsv"}},
+	{Codec: "av1_vaapi", Family: "av1", HWAccel: "vaapi", DecodeArgs: []string{"-hwaccel", "vaapi"}},
+	{Codec: "av1_amf", Family: "av1", HWAccel: "d3d11va", DecodeArgs: []string{"-hwaccel", "d3d11va"}},
+}
+
+// cpuCodecByFamily is the software fallback encoder used when no hardware encoder for a
+// family is available.
+var cpuCodecByFamily = map[string]string{
+	"h265": "libx265",
+	"h264": "libx264",
+	"av1":  "libsvtav1",
+}
+
+// HWAccelCapabilities is the set of encoders and hwaccels this machine's ffmpeg build supports,
+// as reported by DetectHWAccel.
+type HWAccelCapabilities struct {
+	Encoders map[string]bool
+	HWAccels map[string]bool
+}
+
+// DetectHWAccel probes the local ffmpeg build for available hardware encoders and hwaccels.
+func DetectHWAccel() (HWAccelCapabilities, error) {
+	encoders, err := ffmpegOutput("-hide_banner", "-encoders")
+	if err != nil {
+		return HWAccelCapabilities{}, err
+	}
+
+	hwaccels, err := ffmpegOutput("-hide_banner", "-hwaccels")
+	if err != nil {
+		return HWAccelCapabilities{}, err
+	}
+
+	caps := HWAccelCapabilities{
+		Encoders: map[string]bool{
+			"libx265":   strings.Contains(encoders, "libx265"),
+			"libx264":   strings.Contains(encoders, "libx264"),
+			"libsvtav1": strings.Contains(encoders, "libsvtav1"),
+		},
+		HWAccels: map[string]bool{},
+	}
+
+	for _, candidate := range hwCandidates {
+		caps.Encoders[candidate.Codec] = strings.Contains(encoders, candidate.Codec)
+	}
+
+	for _, line := range strings.Split(hwaccels, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		caps.HWAccels[line] = true
+	}
+
+	return caps, nil
+}
+
+// Resolve picks the fastest available encoder for family (e.g. "h265"), along with the
+// decode flags that should be placed ahead of -i when using it. A candidate only counts as
+// available when both its encoder and its hwaccel are present; it falls back to the CPU
+// encoder for the family if no hardware encoder qualifies, and reports ok = false for a family
+// it doesn't know about at all.
+func (c HWAccelCapabilities) Resolve(family string) (codec string, decodeArgs []string, ok bool) {
+	cpuCodec, known := cpuCodecByFamily[family]
+	if !known {
+		return "", nil, false
+	}
+
+	for _, candidate := range hwCandidates {
+		if candidate.Family != family {
+			continue
+		}
+
+		if c.Encoders[candidate.Codec] && c.HWAccels[candidate.HWAccel] {
+			return candidate.Codec, candidate.DecodeArgs, true
+		}
+	}
+
+	return cpuCodec, nil, true
+}
+
+func ffmpegOutput(args ...string) (string, error) {
+	cmd := exec.Command("ffmpeg", args...)
+	var buffer bytes.Buffer
+	cmd.Stdout = &buffer
+
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	return buffer.String(), nil
+}
@@ -0,0 +1,201 @@
+package transcode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// manifestFileName is the state file Execute maintains in the output directory for
+// OnExisting == "resume", recording which inputs have already been transcoded.
+const manifestFileName = ".qonvert-state.json"
+
+// ManifestEntry records the outcome of transcoding one item, keyed by its content hash. Codec,
+// HWAccelArgs, OutputFormat, and Ladder capture the encode settings actually used, so qo retry
+// can reproduce them instead of guessing from the current --codec flag.
+type ManifestEntry struct {
+	Hash     string `json:"hash"`
+	Input    string `json:"input"`
+	Output   string `json:"output"`
+	ExitCode int    `json:"exit_code"`
+
+	Codec        string       `json:"codec"`
+	HWAccelArgs  []string     `json:"hwaccel_args,omitempty"`
+	OutputFormat string       `json:"output_format,omitempty"`
+	Ladder       []LadderRung `json:"ladder,omitempty"`
+}
+
+// manifestEntryFor builds the ManifestEntry for item's outcome, capturing enough of its encode
+// settings to reproduce the same ffmpeg invocation on retry.
+func manifestEntryFor(item Item, codec string, hash string, err error) ManifestEntry {
+	return ManifestEntry{
+		Hash:         hash,
+		Input:        item.InputPath,
+		Output:       item.OutputPath,
+		ExitCode:     exitCode(err),
+		Codec:        codec,
+		HWAccelArgs:  item.HWAccelArgs,
+		OutputFormat: item.OutputFormat,
+		Ladder:       item.Ladder,
+	}
+}
+
+type manifest struct {
+	Entries map[string]ManifestEntry `json:"entries"`
+}
+
+// manifestMu serializes reads and writes of the manifest file across the concurrent workers
+// in a single qonvert run.
+var manifestMu sync.Mutex
+
+func manifestPath(outputPath string) string {
+	return filepath.Join(filepath.Dir(outputPath), manifestFileName)
+}
+
+// ReadManifest loads the resume manifest from outputDir, the directory passed via --output-path.
+// A missing manifest is reported as an empty one, not an error.
+func ReadManifest(outputDir string) ([]ManifestEntry, error) {
+	m, err := loadManifest(filepath.Join(outputDir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]ManifestEntry, 0, len(m.Entries))
+	for _, entry := range m.Entries {
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func loadManifest(path string) (manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest{Entries: map[string]ManifestEntry{}}, nil
+	}
+	if err != nil {
+		return manifest{}, err
+	}
+
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return manifest{}, err
+	}
+	if m.Entries == nil {
+		m.Entries = map[string]ManifestEntry{}
+	}
+
+	return m, nil
+}
+
+// RecordManifestEntry updates entry.Output's resume-manifest entry, keyed by entry.Hash. It's
+// exported for qo retry to mark an item as fixed after a successful re-encode, since it doesn't
+// go through Execute's own resume bookkeeping (it always passes OnExisting: "overwrite").
+func RecordManifestEntry(entry ManifestEntry) error {
+	return recordManifestEntry(entry.Output, entry)
+}
+
+func recordManifestEntry(outputPath string, entry ManifestEntry) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	path := manifestPath(outputPath)
+	m, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+
+	m.Entries[entry.Hash] = entry
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+// hashItem fingerprints item and codec so a later run can recognize whether the same
+// transcode has already been done.
+func hashItem(item Item, codec string) (string, error) {
+	info, err := os.Stat(item.InputPath)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%d|%s|%v", item.InputPath, info.Size(), info.ModTime().UnixNano(), codec, defaultCodecArgs[codec])
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resumeCached reports whether item's hash has a successful, matching, complete manifest
+// entry, meaning it can be skipped. A matching entry whose output is missing or whose frame
+// count falls short of the source (a partially-written output) is not considered done.
+func resumeCached(item Item, hash string) (bool, error) {
+	m, err := loadManifest(manifestPath(item.OutputPath))
+	if err != nil {
+		return false, err
+	}
+
+	entry, ok := m.Entries[hash]
+	if !ok || entry.ExitCode != 0 {
+		return false, nil
+	}
+
+	if _, err := os.Stat(item.OutputPath); err != nil {
+		return false, nil
+	}
+
+	outputFrames, err := ReadFrameCount(item.OutputPath)
+	if err != nil {
+		return false, nil
+	}
+
+	sourceFrames, err := ReadFrameCount(item.InputPath)
+	if err != nil {
+		return false, nil
+	}
+
+	return outputFrames >= sourceFrames, nil
+}
+
+// nextAvailablePath appends "-1", "-2", and so on before outputPath's extension until it finds
+// a path that doesn't already exist.
+func nextAvailablePath(outputPath string) string {
+	if _, err := os.Stat(outputPath); err != nil {
+		return outputPath
+	}
+
+	ext := filepath.Ext(outputPath)
+	base := strings.TrimSuffix(outputPath, ext)
+
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); err != nil {
+			return candidate
+		}
+	}
+}
+
+// exitCode extracts the process exit code from an *exec.ExitError, or -1 if err isn't one
+// (e.g. the process couldn't be started at all).
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
+}
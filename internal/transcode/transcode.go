@@ -1,6 +1,8 @@
 package transcode
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"math/rand"
@@ -8,9 +10,11 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var defaultCodecArgs = map[string][]string{
@@ -29,6 +33,83 @@ var defaultCodecArgs = map[string][]string{
 		// Any higher and the size starts to explode. Any lower and the quality starts to look significantly worse.
 		"-q:v", "65",
 	},
+	"hevc_nvenc": {
+		"-tag:v", "hvc1",
+		"-preset", "p4",
+		"-tune", "hq",
+		"-rc", "vbr",
+		"-cq", "24",
+	},
+	"hevc_qsv": {
+		"-tag:v", "hvc1",
+		"-global_quality", "24",
+		"-look_ahead", "1",
+	},
+	"hevc_vaapi": {
+		"-tag:v", "hvc1",
+		"-qp", "24",
+	},
+	"hevc_amf": {
+		"-tag:v", "hvc1",
+		"-quality", "quality",
+		"-rc", "cqp",
+		"-qp_i", "24",
+		"-qp_p", "24",
+	},
+
+	"libx264": {
+		// libx264's default of 23 is already a good quality/size ratio; no tag:v needed since
+		// h.264 thumbnails already work everywhere.
+		"-crf", "23",
+	},
+	"h264_videotoolbox": {
+		"-q:v", "65",
+	},
+	"h264_nvenc": {
+		"-preset", "p4",
+		"-tune", "hq",
+		"-rc", "vbr",
+		"-cq", "23",
+	},
+	"h264_qsv": {
+		"-global_quality", "23",
+		"-look_ahead", "1",
+	},
+	"h264_vaapi": {
+		"-qp", "23",
+	},
+	"h264_amf": {
+		"-quality", "quality",
+		"-rc", "cqp",
+		"-qp_i", "23",
+		"-qp_p", "23",
+	},
+
+	"libsvtav1": {
+		// AV1 needs a higher CRF than x264/x265 for comparable quality; 30 lands in the same
+		// quality/size ballpark as the -crf 24 used for h.265 above.
+		"-preset", "8",
+		"-crf", "30",
+	},
+	"av1_nvenc": {
+		"-preset", "p4",
+		"-tune", "hq",
+		"-rc", "vbr",
+		"-cq", "30",
+	},
+	"av1_qsv": {
+		"-global_quality", "30",
+		"-look_ahead", "1",
+	},
+	"av1_vaapi": {
+		"-qp", "30",
+	},
+	"av1_amf": {
+		"-quality", "quality",
+		"-rc", "cqp",
+		"-qp_i", "30",
+		"-qp_p", "30",
+	},
 }
 
 func buildArgs(item Item, codec string, socketFilePath string) []string {
@@ -36,12 +117,20 @@ func buildArgs(item Item, codec string, socketFilePath string) []string {
 		// Emit progress to the socket file.
 		"-progress", "unix://" + socketFilePath,
 
-		// Overwrite the output file.
-		// TODO: Maybe provide an option for overriding existing files?
+		// Overwrite the output file. Callers wanting different --on-existing behavior handle it
+		// in Execute before ffmpeg is ever invoked.
 		"-y",
+	}
+
+	args = append(args, item.HWAccelArgs...)
 
+	args = append(args,
 		// The input file.
 		"-i", item.InputPath,
+	)
+
+	if item.OutputFormat == "hls" || item.OutputFormat == "dash" {
+		return append(args, buildLadderArgs(item, codec)...)
 	}
 
 	if codec != "" {
@@ -69,33 +158,223 @@ func buildArgs(item Item, codec string, socketFilePath string) []string {
 	return args
 }
 
-type Result struct {
-	Item  ItemWithProgress
-	Error error
+// LadderRung is one variant of an HLS/DASH ladder, e.g. "720:2500k".
+type LadderRung struct {
+	Height  int
+	Bitrate string
 }
 
-func Execute(item ItemWithProgress, codec string) <-chan Result {
-	sockFilePath, progress := readProgress(item)
-	result := make(chan Result)
+// ParseLadder parses a ladder flag value like "480:1000k,720:2500k,1080:5000k" into its rungs.
+func ParseLadder(spec string) ([]LadderRung, error) {
+	parts := strings.Split(spec, ",")
+	rungs := make([]LadderRung, 0, len(parts))
+
+	for _, part := range parts {
+		heightStr, bitrate, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid ladder rung %q, expected HEIGHT:BITRATE", part)
+		}
+
+		height, err := strconv.Atoi(heightStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ladder rung height %q: %w", heightStr, err)
+		}
+
+		rungs = append(rungs, LadderRung{Height: height, Bitrate: bitrate})
+	}
+
+	return rungs, nil
+}
+
+// buildLadderArgs builds the portion of the ffmpeg invocation, after -i, that encodes item's
+// ladder rungs in one pass and writes them out as an HLS or DASH ladder rooted at item.OutputPath.
+func buildLadderArgs(item Item, codec string) []string {
+	var args []string
+
+	for range item.Ladder {
+		args = append(args, "-map", "0:v:0", "-map", "0:a:0?")
+	}
+
+	if codec != "" {
+		args = append(args, "-c:v", codec)
+		args = append(args, defaultCodecArgs[codec]...)
+	} else {
+		args = append(args, "-c:v", "libx264")
+	}
+	args = append(args, "-c:a", "aac")
+
+	for i, rung := range item.Ladder {
+		args = append(args,
+			fmt.Sprintf("-filter:v:%d", i), fmt.Sprintf("scale=-2:%d", rung.Height),
+			fmt.Sprintf("-b:v:%d", i), rung.Bitrate,
+		)
+	}
+
+	if item.OutputFormat == "dash" {
+		return append(args, buildDashMuxerArgs(item)...)
+	}
+
+	return append(args, buildHLSMuxerArgs(item)...)
+}
+
+// buildHLSMuxerArgs builds the hls-muxer-private options for buildLadderArgs. These are rejected
+// by the dash muxer, so they must never be passed alongside -f dash.
+func buildHLSMuxerArgs(item Item) []string {
+	var streamMap strings.Builder
+	for i, rung := range item.Ladder {
+		if i > 0 {
+			streamMap.WriteString(" ")
+		}
+		fmt.Fprintf(&streamMap, "v:%d,a:%d,name:%dp", i, i, rung.Height)
+	}
+
+	return []string{
+		"-var_stream_map", streamMap.String(),
+		"-hls_time", "6",
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(item.OutputPath, "%v", "seg_%03d.ts"),
+		"-master_pl_name", "master.m3u8",
+		"-f", "hls",
+		filepath.Join(item.OutputPath, "%v", "stream.m3u8"),
+	}
+}
+
+// buildDashMuxerArgs builds the dash-muxer options for buildLadderArgs. Every -map'd video stream
+// lands in one adaptation set and every audio stream in another, which is all item.Ladder needs
+// since ffmpeg already groups bitrate variants under a shared adaptation set by stream type.
+func buildDashMuxerArgs(item Item) []string {
+	return []string{
+		"-seg_duration", "6",
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", "id=0,streams=v id=1,streams=a",
+		"-f", "dash",
+		filepath.Join(item.OutputPath, "manifest.mpd"),
+	}
+}
+
+func Execute(item ItemWithProgress, codec string, progress chan<- ItemWithProgress) error {
+	rungs := 1
+	if len(item.Item.Ladder) > 0 {
+		rungs = len(item.Item.Ladder)
+	}
+
+	var resumeHash string
+	switch item.Item.OnExisting {
+	case "skip":
+		if _, err := os.Stat(item.Item.OutputPath); err == nil {
+			return markDone(item, progress)
+		}
+	case "rename":
+		item.Item.OutputPath = nextAvailablePath(item.Item.OutputPath)
+	case "resume":
+		hash, err := hashItem(*item.Item, codec)
+		if err != nil {
+			return err
+		}
+		resumeHash = hash
+
+		cached, err := resumeCached(*item.Item, hash)
+		if err != nil {
+			return err
+		}
+		if cached {
+			return markDone(item, progress)
+		}
+	}
+
+	if item.Item.OutputFormat != "" {
+		if err := os.MkdirAll(item.Item.OutputPath, 0o755); err != nil {
+			return err
+		}
+	}
+
+	sockFilePath, itemProgress := readProgress(item, rungs)
+	done := make(chan struct{})
 	go func() {
-		for p := range progress {
-			result <- Result{Item: p, Error: nil}
+		for p := range itemProgress {
+			progress <- p
 		}
+		close(done)
 	}()
 
 	args := buildArgs(*item.Item, codec, sockFilePath)
 	cmd := exec.Command("ffmpeg", args[:]...)
-	go func() {
-		err := cmd.Run()
-		result <- Result{Item: item, Error: err}
-		close(result)
-	}()
+	err := cmd.Run()
 
-	return result
+	<-done
+	close(progress)
+
+	if resumeHash != "" {
+		entry := manifestEntryFor(*item.Item, codec, resumeHash, err)
+		if recordErr := recordManifestEntry(item.Item.OutputPath, entry); recordErr != nil && err == nil {
+			return recordErr
+		}
+	}
+
+	return err
+}
+
+// markDone reports item as already complete without running ffmpeg, satisfying the progress
+// bar and the wg.Done() contract callers rely on.
+func markDone(item ItemWithProgress, progress chan<- ItemWithProgress) error {
+	progress <- ItemWithProgress{Item: item.Item, CurrentFrame: item.FrameCount, FrameCount: item.FrameCount}
+	close(progress)
+	return nil
+}
+
+// ProgressEvent is one update parsed out of ffmpeg's `-progress` key=value stream, covering one
+// "frame" of progress reporting (ffmpeg emits a batch of keys ending in a progress= line).
+type ProgressEvent struct {
+	Frame       uint64
+	FPS         float64
+	BitrateKbps float64
+	TotalSize   uint64
+	OutTime     time.Duration
+	Speed       float64
+
+	// Progress is "continue" until the final event for the run, which is "end".
+	Progress string
+}
+
+// parseProgressEvent turns the key=value fields accumulated since the last progress= line into
+// a ProgressEvent. Fields ffmpeg didn't emit, or that fail to parse, are left at their zero value.
+func parseProgressEvent(fields map[string]string) ProgressEvent {
+	event := ProgressEvent{Progress: fields["progress"]}
+
+	if v, err := strconv.ParseUint(fields["frame"], 10, 64); err == nil {
+		event.Frame = v
+	}
+
+	if v, err := strconv.ParseFloat(fields["fps"], 64); err == nil {
+		event.FPS = v
+	}
+
+	if v, err := strconv.ParseFloat(strings.TrimSuffix(fields["bitrate"], "kbits/s"), 64); err == nil {
+		event.BitrateKbps = v
+	}
+
+	if v, err := strconv.ParseUint(fields["total_size"], 10, 64); err == nil {
+		event.TotalSize = v
+	}
+
+	if v, err := strconv.ParseInt(fields["out_time_us"], 10, 64); err == nil {
+		event.OutTime = time.Duration(v) * time.Microsecond
+	}
+
+	if v, err := strconv.ParseFloat(strings.TrimSuffix(fields["speed"], "x"), 64); err == nil {
+		event.Speed = v
+	}
+
+	return event
 }
 
 // Taken from https://github.com/u2takey/ffmpeg-go/blob/898ebfd93985f0f69cde36e466094cd453caa349/examples/showProgress.go#L41
-func readProgress(item ItemWithProgress) (string, <-chan ItemWithProgress) {
+//
+// rungs is the number of HLS/DASH ladder variants ffmpeg is encoding in this invocation. ffmpeg
+// reports one frame= counter summed across every rung, so it's divided back down to a
+// per-rendition frame count.
+func readProgress(item ItemWithProgress, rungs int) (string, <-chan ItemWithProgress) {
 	progress := make(chan ItemWithProgress)
 
 	socketFilePath := path.Join(os.TempDir(), fmt.Sprintf("%d_sock", rand.Int()))
@@ -105,47 +384,342 @@ func readProgress(item ItemWithProgress) (string, <-chan ItemWithProgress) {
 	}
 
 	go func() {
-		re := regexp.MustCompile(`frame=(\d+)`)
+		defer close(progress)
 
 		fd, err := l.Accept()
 		if err != nil {
 			log.Fatal("accept error:", err)
 		}
 
-		buf := make([]byte, 16)
-		data := ""
+		fields := map[string]string{}
+		scanner := bufio.NewScanner(fd)
 
-		for {
-			_, err := fd.Read(buf)
-			if err != nil {
-				fmt.Println(err)
-				close(progress)
-				return
+		// lastFrame is the most recent frame count ffmpeg actually reported. item.FrameCount is
+		// the whole item's total, which is only the right "done" value for a whole-file encode;
+		// for a segment of a larger file it would wildly overshoot, so the "end" event below
+		// reports lastFrame instead of assuming completion means item.FrameCount.
+		var lastFrame uint64
+
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), "=")
+			if !ok {
+				continue
+			}
+			fields[key] = value
+
+			if key != "progress" {
+				continue
 			}
 
-			data += string(buf)
-			a := re.FindAllStringSubmatch(data, -1)
-			value := uint64(0)
+			event := parseProgressEvent(fields)
+			fields = map[string]string{}
 
-			if len(a) > 0 && len(a[len(a)-1]) > 0 {
-				c, err := strconv.ParseUint(a[len(a)-1][len(a[len(a)-1])-1], 10, 64)
-				if err != nil {
-					fmt.Println(err)
-					close(progress)
-					return
+			if event.Progress == "end" {
+				progress <- ItemWithProgress{
+					Item:         item.Item,
+					CurrentFrame: lastFrame,
+					FrameCount:   item.FrameCount,
+					FPS:          event.FPS,
+					Speed:        event.Speed,
+					BitrateKbps:  event.BitrateKbps,
+					OutTime:      event.OutTime,
+					Progress:     event.Progress,
 				}
-				value = c
+				return
 			}
 
-			if strings.Contains(data, "progress=end") {
-				progress <- ItemWithProgress{Item: item.Item, CurrentFrame: item.FrameCount, FrameCount: item.FrameCount}
-				close(progress)
-				return
+			lastFrame = event.Frame / uint64(rungs)
+
+			progress <- ItemWithProgress{
+				Item:         item.Item,
+				CurrentFrame: lastFrame,
+				FrameCount:   item.FrameCount,
+				FPS:          event.FPS,
+				Speed:        event.Speed,
+				BitrateKbps:  event.BitrateKbps,
+				OutTime:      event.OutTime,
+				Progress:     event.Progress,
 			}
+		}
 
-			progress <- ItemWithProgress{Item: item.Item, CurrentFrame: value, FrameCount: item.FrameCount}
+		if err := scanner.Err(); err != nil {
+			fmt.Println(err)
 		}
 	}()
 
 	return socketFilePath, progress
 }
+
+// ReadKeyframes returns the presentation timestamps, in seconds, of every keyframe in the
+// first video stream of path, in ascending order.
+func ReadKeyframes(path FilePath) ([]float64, error) {
+	args := [...]string{
+		"-v", "error",
+		"-skip_frame", "nokey",
+		"-select_streams", "v:0",
+		"-show_entries", "frame=pts_time",
+		"-of", "csv=p=0",
+		path,
+	}
+
+	cmd := exec.Command("ffprobe", args[:]...)
+	var buffer bytes.Buffer
+	cmd.Stdout = &buffer
+
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	keyframes := make([]float64, 0, len(lines))
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		pts, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return nil, err
+		}
+		keyframes = append(keyframes, pts)
+	}
+
+	return keyframes, nil
+}
+
+// segmentBound is a keyframe-aligned [start, end) range of a source file, in seconds. The
+// final segment of a split has no end, running to the end of the file.
+type segmentBound struct {
+	start  float64
+	end    float64
+	hasEnd bool
+}
+
+// segmentBounds splits keyframes into n contiguous, keyframe-aligned ranges.
+func segmentBounds(keyframes []float64, n int) []segmentBound {
+	step := len(keyframes) / n
+
+	bounds := make([]segmentBound, 0, n)
+	for i := 0; i < n; i++ {
+		start := keyframes[i*step]
+
+		if i == n-1 {
+			bounds = append(bounds, segmentBound{start: start})
+			continue
+		}
+
+		bounds = append(bounds, segmentBound{start: start, end: keyframes[(i+1)*step], hasEnd: true})
+	}
+
+	return bounds
+}
+
+func buildSegmentArgs(item Item, codec string, bound segmentBound, outputPath, socketFilePath string) []string {
+	args := []string{
+		// Emit progress to the socket file.
+		"-progress", "unix://" + socketFilePath,
+
+		// Overwrite the output file.
+		"-y",
+
+		// Seek to the start of the segment before reading the input, so ffmpeg doesn't decode
+		// and discard everything before it.
+		"-ss", strconv.FormatFloat(bound.start, 'f', 3, 64),
+	}
+
+	if bound.hasEnd {
+		args = append(args, "-to", strconv.FormatFloat(bound.end, 'f', 3, 64))
+	}
+
+	args = append(args, "-i", item.InputPath)
+
+	if codec != "" {
+		args = append(args,
+			"-c:v", codec,
+		)
+		args = append(args,
+			defaultCodecArgs[codec]...,
+		)
+	}
+
+	args = append(args,
+		// Audio is re-joined once, during the whole-file concat, rather than re-encoded per segment.
+		"-c:a", "copy",
+
+		"-pix_fmt", "yuv420p",
+		"-vf", "crop=trunc(iw/2)*2:trunc(ih/2)*2",
+
+		outputPath,
+	)
+
+	return args
+}
+
+func executeSegment(item ItemWithProgress, codec string, bound segmentBound, outputPath string, progress chan<- ItemWithProgress) error {
+	sockFilePath, itemProgress := readProgress(item, 1)
+	done := make(chan struct{})
+	go func() {
+		for p := range itemProgress {
+			progress <- p
+		}
+		close(done)
+	}()
+
+	args := buildSegmentArgs(*item.Item, codec, bound, outputPath, sockFilePath)
+	cmd := exec.Command("ffmpeg", args[:]...)
+	err := cmd.Run()
+
+	<-done
+	close(progress)
+
+	return err
+}
+
+func concatSegments(tempDir string, segmentPaths []string, outputPath string) error {
+	var list strings.Builder
+	for _, segmentPath := range segmentPaths {
+		fmt.Fprintf(&list, "file '%s'\n", segmentPath)
+	}
+
+	listPath := filepath.Join(tempDir, "list.txt")
+	if err := os.WriteFile(listPath, []byte(list.String()), 0o644); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("ffmpeg",
+		"-y",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listPath,
+		"-c", "copy",
+		outputPath,
+	)
+	return cmd.Run()
+}
+
+// SegmentedExecute speeds up transcoding a single large file by splitting it into
+// keyframe-aligned segments, encoding them concurrently, and stitching the results back together
+// with ffmpeg's concat demuxer. It falls back to a whole-file Execute if the source has fewer
+// keyframes than segments.
+func SegmentedExecute(item ItemWithProgress, codec string, segments int, progress chan<- ItemWithProgress) error {
+	keyframes, err := ReadKeyframes(item.Item.InputPath)
+	if err != nil {
+		return err
+	}
+
+	if len(keyframes) < segments {
+		return Execute(item, codec, progress)
+	}
+
+	var resumeHash string
+	switch item.Item.OnExisting {
+	case "skip":
+		if _, err := os.Stat(item.Item.OutputPath); err == nil {
+			return markDone(item, progress)
+		}
+	case "rename":
+		item.Item.OutputPath = nextAvailablePath(item.Item.OutputPath)
+	case "resume":
+		hash, err := hashItem(*item.Item, codec)
+		if err != nil {
+			return err
+		}
+		resumeHash = hash
+
+		cached, err := resumeCached(*item.Item, hash)
+		if err != nil {
+			return err
+		}
+		if cached {
+			return markDone(item, progress)
+		}
+	}
+
+	tempDir, err := os.MkdirTemp("", "qonvert-segments-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	bounds := segmentBounds(keyframes, segments)
+	segmentPaths := make([]string, len(bounds))
+	segmentFrames := make([]uint64, len(bounds))
+	segmentErrors := make([]error, len(bounds))
+
+	var framesMu sync.Mutex
+	var wg sync.WaitGroup
+	var forwarders sync.WaitGroup
+	wg.Add(len(bounds))
+	forwarders.Add(len(bounds))
+
+	for i, bound := range bounds {
+		i, bound := i, bound
+		segmentPaths[i] = filepath.Join(tempDir, fmt.Sprintf("segment_%03d.mkv", i))
+
+		go func() {
+			defer wg.Done()
+
+			segmentProgress := make(chan ItemWithProgress)
+			go func() {
+				defer forwarders.Done()
+
+				for p := range segmentProgress {
+					// Hold framesMu across the send so two forwarders' snapshots can never reach
+					// progress out of order; an out-of-order pair would underflow the consumer's
+					// uint64 delta-from-previous calculation.
+					framesMu.Lock()
+					segmentFrames[i] = p.CurrentFrame
+					var total uint64
+					for _, frames := range segmentFrames {
+						total += frames
+					}
+					progress <- ItemWithProgress{Item: item.Item, CurrentFrame: total, FrameCount: item.FrameCount}
+					framesMu.Unlock()
+				}
+			}()
+
+			segmentErrors[i] = executeSegment(item, codec, bound, segmentPaths[i], segmentProgress)
+		}()
+	}
+
+	// Every executeSegment has returned, which means every segmentProgress has been closed, but
+	// the forwarding goroutines draining those channels into progress may still be mid-send.
+	// Wait for them too before anyone closes progress, or a forwarder can panic sending on a
+	// closed channel.
+	wg.Wait()
+	forwarders.Wait()
+
+	for _, err := range segmentErrors {
+		if err != nil {
+			close(progress)
+			if resumeHash != "" {
+				entry := manifestEntryFor(*item.Item, codec, resumeHash, err)
+				if recordErr := recordManifestEntry(item.Item.OutputPath, entry); recordErr != nil {
+					return recordErr
+				}
+			}
+			return err
+		}
+	}
+
+	concatErr := concatSegments(tempDir, segmentPaths, item.Item.OutputPath)
+
+	if resumeHash != "" {
+		entry := manifestEntryFor(*item.Item, codec, resumeHash, concatErr)
+		if recordErr := recordManifestEntry(item.Item.OutputPath, entry); recordErr != nil && concatErr == nil {
+			close(progress)
+			return recordErr
+		}
+	}
+
+	if concatErr != nil {
+		close(progress)
+		return concatErr
+	}
+
+	progress <- ItemWithProgress{Item: item.Item, CurrentFrame: item.FrameCount, FrameCount: item.FrameCount}
+	close(progress)
+
+	return nil
+}